@@ -0,0 +1,138 @@
+package dockerd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TLSPaths holds the filesystem locations of a throwaway CA plus server and
+// client keypair generated by GenerateTLSCerts.
+type TLSPaths struct {
+	CACert string
+
+	ServerCert string
+	ServerKey  string
+
+	ClientCert string
+	ClientKey  string
+}
+
+// GenerateTLSCerts synthesizes a self-signed CA and a server/client keypair
+// signed by it, writing PEM files under dir. The layout matches what dockerd
+// expects for --tlscacert/--tlscert/--tlskey and what a docker client expects
+// under DOCKER_CERT_PATH (ca.pem, cert.pem, key.pem).
+func GenerateTLSCerts(dir string) (*TLSPaths, error) {
+	caKey, caCertDER, caCert, err := generateCert(nil, nil, "buildkit-integration-ca", true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate CA certificate")
+	}
+	if err := writeCert(filepath.Join(dir, "ca.pem"), caCertDER); err != nil {
+		return nil, err
+	}
+
+	serverKey, serverCertDER, _, err := generateCert(caKey, caCert, "localhost", false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate server certificate")
+	}
+	serverKeyPath := filepath.Join(dir, "server-key.pem")
+	serverCertPath := filepath.Join(dir, "server-cert.pem")
+	if err := writeCert(serverCertPath, serverCertDER); err != nil {
+		return nil, err
+	}
+	if err := writeKey(serverKeyPath, serverKey); err != nil {
+		return nil, err
+	}
+
+	clientKey, clientCertDER, _, err := generateCert(caKey, caCert, "buildkit-integration-client", false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate client certificate")
+	}
+	clientKeyPath := filepath.Join(dir, "key.pem")
+	clientCertPath := filepath.Join(dir, "cert.pem")
+	if err := writeCert(clientCertPath, clientCertDER); err != nil {
+		return nil, err
+	}
+	if err := writeKey(clientKeyPath, clientKey); err != nil {
+		return nil, err
+	}
+
+	return &TLSPaths{
+		CACert:     filepath.Join(dir, "ca.pem"),
+		ServerCert: serverCertPath,
+		ServerKey:  serverKeyPath,
+		ClientCert: clientCertPath,
+		ClientKey:  clientKeyPath,
+	}, nil
+}
+
+func writeCert(path string, der []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func writeKey(path string, key *rsa.PrivateKey) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// generateCert creates a certificate for cn, marked as a CA when isCA is set.
+// When signerKey/signerCert are nil, the certificate is self-signed;
+// otherwise it is signed by them, suitable for dockerd's --tlscert or a
+// client's cert.pem. Every certificate is valid for 127.0.0.1/localhost.
+func generateCert(signerKey *rsa.PrivateKey, signerCert *x509.Certificate, cn string, isCA bool) (*rsa.PrivateKey, []byte, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+
+	parent, parentKey := tmpl, key
+	if signerCert != nil {
+		parent, parentKey = signerCert, signerKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, der, cert, nil
+}
@@ -0,0 +1,110 @@
+// Package dockerd provides a throwaway dockerd process for use by the
+// integration test workers in util/testutil/integration.
+package dockerd
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Config mirrors the subset of dockerd's daemon.json that the integration
+// workers need to configure for a test run.
+type Config struct {
+	Features map[string]bool `json:"features,omitempty"`
+	Mirrors  []string        `json:"registry-mirrors,omitempty"`
+	Builder  struct {
+		Entitlements struct {
+			NetworkHost      bool `json:"network-host,omitempty"`
+			SecurityInsecure bool `json:"security-insecure,omitempty"`
+		} `json:"entitlements,omitempty"`
+	} `json:"builder,omitempty"`
+
+	TLS       bool     `json:"tls,omitempty"`
+	TLSVerify bool     `json:"tlsverify,omitempty"`
+	TLSCACert string   `json:"tlscacert,omitempty"`
+	TLSCert   string   `json:"tlscert,omitempty"`
+	TLSKey    string   `json:"tlskey,omitempty"`
+	Hosts     []string `json:"hosts,omitempty"`
+}
+
+// Daemon manages a single dockerd process rooted at a private workDir.
+type Daemon struct {
+	workDir         string
+	sockPath        string
+	hostsFromConfig bool
+	cmd             *exec.Cmd
+}
+
+// NewDaemon returns a Daemon that will listen on a unix socket under workDir
+// once started. workDir is also used as the daemon's data-root and pidfile
+// location.
+func NewDaemon(workDir string) (*Daemon, error) {
+	return &Daemon{
+		workDir:  workDir,
+		sockPath: "unix://" + filepath.Join(workDir, "docker.sock"),
+	}, nil
+}
+
+// Sock returns the unix socket address the daemon listens (or will listen)
+// on.
+func (d *Daemon) Sock() string {
+	return d.sockPath
+}
+
+// UseConfigHosts tells the Daemon that "hosts" is already set in the
+// daemon.json it will be started with, so StartWithError must not also pass
+// a default --host flag: dockerd refuses to start when a directive is
+// specified both as a flag and in the configuration file.
+func (d *Daemon) UseConfigHosts() {
+	d.hostsFromConfig = true
+}
+
+// StartWithError starts dockerd with the given flags, appended to the
+// defaults derived from workDir. Output is appended to logs, keyed by
+// workDir.
+func (d *Daemon) StartWithError(logs map[string]*bytes.Buffer, providedArgs ...string) error {
+	args := []string{
+		"--data-root", filepath.Join(d.workDir, "daemon-root"),
+		"--exec-root", filepath.Join(d.workDir, "daemon-exec"),
+		"--pidfile", filepath.Join(d.workDir, "docker.pid"),
+	}
+	if !d.hostsFromConfig {
+		args = append(args, "--host", d.sockPath)
+	}
+	args = append(args, providedArgs...)
+
+	if err := os.MkdirAll(d.workDir, 0700); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("dockerd", args...)
+	if logs != nil {
+		buf, ok := logs[d.workDir]
+		if !ok {
+			buf = new(bytes.Buffer)
+			logs[d.workDir] = buf
+		}
+		cmd.Stdout = buf
+		cmd.Stderr = buf
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start dockerd")
+	}
+	d.cmd = cmd
+	return nil
+}
+
+// StopWithError stops a running daemon started via StartWithError.
+func (d *Daemon) StopWithError() error {
+	if d.cmd == nil || d.cmd.Process == nil {
+		return nil
+	}
+	if err := d.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	return d.cmd.Wait()
+}
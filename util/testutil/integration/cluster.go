@@ -0,0 +1,278 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/moby/buildkit/util/testutil/dockerd"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultClusterSize is how many dockerd instances newCluster starts when
+// BUILDKIT_INTEGRATION_DOCKERD_CLUSTER_SIZE isn't set.
+const defaultClusterSize = 2
+
+func clusterSize() int {
+	s := os.Getenv("BUILDKIT_INTEGRATION_DOCKERD_CLUSTER_SIZE")
+	if s == "" {
+		return defaultClusterSize
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return defaultClusterSize
+	}
+	return n
+}
+
+// newCluster starts clusterSize() dockerd instances under a shared workDir
+// root, each pointed at its predecessor as a registry pull-through mirror, so
+// tests can exercise cross-daemon cache import/export. The returned backend's
+// address round-robins the hijack proxy across every daemon in the cluster.
+func (c moby) newCluster(ctx context.Context, cfg *BackendConfig) (b Backend, cl func() error, err error) {
+	deferF := &multiCloser{}
+	cl = deferF.F()
+
+	defer func() {
+		if err != nil {
+			deferF.F()()
+			cl = nil
+		}
+	}()
+
+	var proxyGroup errgroup.Group
+	deferF.append(proxyGroup.Wait)
+
+	root, err := os.MkdirTemp("", "integration-cluster")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := clusterSize()
+	apis := make([]*client.Client, 0, n)
+	var prevAddr string
+	for i := 0; i < n; i++ {
+		workDir := filepath.Join(root, fmt.Sprintf("daemon-%d", i))
+		if err := os.MkdirAll(workDir, 0700); err != nil {
+			return nil, nil, err
+		}
+
+		d, err := dockerd.NewDaemon(workDir)
+		if err != nil {
+			return nil, nil, errors.Errorf("new daemon error: %q, %s", err, formatLogs(cfg.Logs))
+		}
+
+		dcfg := dockerd.Config{
+			Features: map[string]bool{"containerd-snapshotter": true},
+			Hosts:    []string{d.Sock()},
+		}
+		if prevAddr != "" {
+			dcfg.Mirrors = []string{"http://" + prevAddr}
+		}
+
+		dcfgdt, err := json.Marshal(dcfg)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to marshal dockerd config")
+		}
+		dockerdConfigFile := filepath.Join(workDir, "daemon.json")
+		if err := os.WriteFile(dockerdConfigFile, dcfgdt, 0644); err != nil {
+			return nil, nil, err
+		}
+		d.UseConfigHosts()
+
+		// Deliberately leave the userland proxy enabled here (unlike the
+		// other workers): the next daemon in the chain reaches this one's
+		// mirror registry over a loopback-published port, and with
+		// --userland-proxy=false that hop depends on iptables DNAT/hairpin
+		// routing that isn't reliably in place on every host. The userland
+		// proxy forwards at the socket level instead, so the mirror chain
+		// just works.
+		err = d.StartWithError(cfg.Logs,
+			"--config-file", dockerdConfigFile,
+			"--debug",
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		deferF.append(d.StopWithError)
+
+		if err := waitUnix(d.Sock(), 5*time.Second, nil); err != nil {
+			return nil, nil, errors.Errorf("dockerd did not start up: %q, %s", err, formatLogs(cfg.Logs))
+		}
+
+		dockerAPI, err := client.NewClientWithOpts(client.WithHost(d.Sock()))
+		if err != nil {
+			return nil, nil, err
+		}
+		deferF.append(dockerAPI.Close)
+
+		if err := waitForAPI(ctx, dockerAPI, 5*time.Second); err != nil {
+			return nil, nil, errors.Wrapf(err, "dockerd client api timed out: %s", formatLogs(cfg.Logs))
+		}
+
+		apis = append(apis, dockerAPI)
+
+		// Publish a pull-through registry:2 mirror on this daemon so the
+		// *next* daemon in the chain can point registry-mirrors at it.
+		// dockerd itself doesn't speak the registry v2 API, so the mirror
+		// has to be a real registry container, not dockerAPI's own address.
+		// Each mirror proxies to the *previous* daemon's mirror rather than
+		// straight to docker.io, so the chain daemon 0 -> 1 -> ... -> n-1 is
+		// real: daemon i's mirror only ever gets populated by daemon i-1's,
+		// which is the whole point of this worker.
+		upstream := mirrorRegistryUpstream
+		if prevAddr != "" {
+			upstream = "http://" + prevAddr
+		}
+		mirrorAddr, removeMirror, err := startMirrorRegistry(ctx, dockerAPI, upstream)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to start mirror registry on daemon %d: %s", i, formatLogs(cfg.Logs))
+		}
+		deferF.append(removeMirror)
+		prevAddr = mirrorAddr
+	}
+
+	unsupported, err := detectUnsupportedFeatures(ctx, apis[0], false)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to probe dockerd cluster for supported features: %s", formatLogs(cfg.Logs))
+	}
+
+	address, err := roundRobinHijackProxyListener(ctx, apis, &proxyGroup, deferF, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return backend{
+		address:             address,
+		rootless:            c.rootless,
+		isDockerd:           true,
+		unsupportedFeatures: unsupported,
+	}, cl, nil
+}
+
+// mirrorRegistryUpstream is what the first daemon's registry:2 pull-through
+// mirror proxies to; every later daemon's mirror instead proxies to the
+// previous daemon's mirror address, so the chain is real rather than every
+// hop independently proxying to docker.io.
+const mirrorRegistryUpstream = "https://registry-1.docker.io"
+
+// startMirrorRegistry runs a registry:2 container configured as a
+// pull-through cache of upstream on dockerAPI, publishing it on a
+// host-reachable loopback port, and returns that address (suitable for
+// another daemon's registry-mirrors) plus a cleanup func that removes the
+// container. dockerd doesn't serve the registry v2 API itself, so the
+// "mirror" a daemon offers its successor has to be an actual registry, run
+// as a container on it.
+func startMirrorRegistry(ctx context.Context, dockerAPI *client.Client, upstream string) (addr string, cleanup func() error, err error) {
+	rc, err := dockerAPI.ImagePull(ctx, "registry:2", types.ImagePullOptions{})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to pull registry:2")
+	}
+	_, err = io.Copy(io.Discard, rc)
+	rc.Close()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to pull registry:2")
+	}
+
+	hostAddr, err := freeTCPAddr()
+	if err != nil {
+		return "", nil, err
+	}
+	_, hostPort, err := net.SplitHostPort(hostAddr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := dockerAPI.ContainerCreate(ctx,
+		&container.Config{
+			Image: "registry:2",
+			Env:   []string{"REGISTRY_PROXY_REMOTEURL=" + upstream},
+			ExposedPorts: nat.PortSet{
+				"5000/tcp": {},
+			},
+		},
+		&container.HostConfig{
+			PortBindings: nat.PortMap{
+				"5000/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}},
+			},
+		},
+		nil, nil, "",
+	)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create mirror registry container")
+	}
+
+	if err := dockerAPI.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return "", nil, errors.Wrap(err, "failed to start mirror registry container")
+	}
+
+	cleanup = func() error {
+		return dockerAPI.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	}
+	return "127.0.0.1:" + hostPort, cleanup, nil
+}
+
+// roundRobinHijackProxyListener is hijackProxyListener extended to spread
+// accepted connections across multiple daemons, one dockerAPI per accepted
+// conn, cycling through apis in order.
+func roundRobinHijackProxyListener(ctx context.Context, apis []*client.Client, proxyGroup *errgroup.Group, deferF *multiCloser, cfg *BackendConfig) (string, error) {
+	f, err := os.CreateTemp("", "buildkit-integration")
+	if err != nil {
+		return "", err
+	}
+	localPath := f.Name()
+	f.Close()
+	os.Remove(localPath)
+
+	listener, err := net.Listen("unix", localPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "dockerd listener error: %s", formatLogs(cfg.Logs))
+	}
+	deferF.append(listener.Close)
+
+	var next int
+	proxyGroup.Go(func() error {
+		for {
+			tmpConn, err := listener.Accept()
+			if err != nil {
+				// Ignore the error from accept which is always a system error.
+				return nil
+			}
+			dockerAPI := apis[next%len(apis)]
+			next++
+
+			conn, err := dockerAPI.DialHijack(ctx, "/grpc", "h2c", nil)
+			if err != nil {
+				return err
+			}
+
+			proxyGroup.Go(func() error {
+				_, err := io.Copy(conn, tmpConn)
+				if err != nil {
+					return err
+				}
+				return tmpConn.Close()
+			})
+			proxyGroup.Go(func() error {
+				_, err := io.Copy(tmpConn, conn)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			})
+		}
+	})
+
+	return "unix://" + listener.Addr().String(), nil
+}
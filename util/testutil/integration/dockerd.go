@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
 	"github.com/moby/buildkit/cmd/buildkitd/config"
 	"github.com/moby/buildkit/util/testutil/dockerd"
 	"github.com/pkg/errors"
@@ -18,44 +22,43 @@ import (
 )
 
 // InitDockerdWorker registers a dockerd worker with the global registry.
+//
+// unsupportedFeatures is no longer hardcoded per worker: it's derived from
+// the running daemon's /info and /version by detectUnsupportedFeatures, so
+// a dockerd upgrade that gains a capability doesn't require editing this
+// file. See detectUnsupportedFeatures.
 func InitDockerdWorker() {
 	Register(&moby{
 		name:     "dockerd",
 		rootless: false,
-		unsupported: []string{
-			FeatureCacheExport,
-			FeatureCacheImport,
-			FeatureCacheBackendAzblob,
-			FeatureCacheBackendGha,
-			FeatureCacheBackendLocal,
-			FeatureCacheBackendRegistry,
-			FeatureCacheBackendS3,
-			FeatureDirectPush,
-			FeatureImageExporter,
-			FeatureMultiCacheExport,
-			FeatureMultiPlatform,
-			FeatureOCIExporter,
-			FeatureOCILayout,
-			FeatureProvenance,
-			FeatureSBOM,
-			FeatureSecurityMode,
-			FeatureCNINetwork,
-		},
 	})
 	Register(&moby{
 		name:     "dockerd-containerd",
 		rootless: false,
-		unsupported: []string{
-			FeatureSecurityMode,
-			FeatureCNINetwork,
-		},
+	})
+	Register(&moby{
+		name:     "dockerd-tls",
+		rootless: false,
+		tls:      true,
+	})
+	Register(&moby{
+		name:     "dockerd-swarm",
+		rootless: false,
+		swarm:    true,
+	})
+	Register(&moby{
+		name:     "dockerd-cluster",
+		rootless: false,
+		cluster:  true,
 	})
 }
 
 type moby struct {
-	name        string
-	rootless    bool
-	unsupported []string
+	name     string
+	rootless bool
+	tls      bool
+	swarm    bool
+	cluster  bool
 }
 
 func (c moby) Name() string {
@@ -67,10 +70,21 @@ func (c moby) Rootless() bool {
 }
 
 func (c moby) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl func() error, err error) {
+	// Reusing an already-running daemon needs none of the privileges that
+	// spawning our own dockerd does, so check for it before requireRoot -
+	// that's the whole point of being able to point at a rootless/remote one.
+	if host := os.Getenv("BUILDKIT_INTEGRATION_DOCKERD_HOST"); host != "" {
+		return c.newExisting(ctx, cfg, host)
+	}
+
 	if err := requireRoot(); err != nil {
 		return nil, nil, err
 	}
 
+	if c.cluster {
+		return c.newCluster(ctx, cfg)
+	}
+
 	bkcfg, err := config.LoadFile(cfg.ConfigFile)
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "failed to load buildkit config file %s", cfg.ConfigFile)
@@ -130,6 +144,45 @@ func (c moby) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl func()
 		return nil, nil, err
 	}
 
+	var tcpAddr string
+	var dockerAPI *client.Client
+	if c.tls {
+		tcpAddr, err = freeTCPAddr()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		certs, err := dockerd.GenerateTLSCerts(workDir)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to generate tls certs")
+		}
+		dcfg.TLS = true
+		dcfg.TLSVerify = true
+		dcfg.TLSCACert = certs.CACert
+		dcfg.TLSCert = certs.ServerCert
+		dcfg.TLSKey = certs.ServerKey
+		dcfg.Hosts = []string{"tcp://" + tcpAddr, d.Sock()}
+		d.UseConfigHosts()
+
+		dcfgdt, err = json.Marshal(dcfg)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to marshal dockerd config")
+		}
+		if err := os.WriteFile(dockerdConfigFile, dcfgdt, 0644); err != nil {
+			return nil, nil, err
+		}
+
+		dockerAPI, err = tlsClient("https://"+tcpAddr, certs)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		dockerAPI, err = client.NewClientWithOpts(client.WithHost(d.Sock()))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	dockerdFlags := []string{
 		"--config-file", dockerdConfigFile,
 		"--userland-proxy=false",
@@ -144,28 +197,111 @@ func (c moby) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl func()
 		return nil, nil, err
 	}
 	deferF.append(d.StopWithError)
+	deferF.append(dockerAPI.Close)
+
+	if !c.tls {
+		if err := waitUnix(d.Sock(), 5*time.Second, nil); err != nil {
+			return nil, nil, errors.Errorf("dockerd did not start up: %q, %s", err, formatLogs(cfg.Logs))
+		}
+	}
+
+	err = waitForAPI(ctx, dockerAPI, 5*time.Second)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "dockerd client api timed out: %s", formatLogs(cfg.Logs))
+	}
+
+	unsupported, err := detectUnsupportedFeatures(ctx, dockerAPI, dcfg.Builder.Entitlements.SecurityInsecure)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to probe dockerd for supported features: %s", formatLogs(cfg.Logs))
+	}
 
-	if err := waitUnix(d.Sock(), 5*time.Second, nil); err != nil {
-		return nil, nil, errors.Errorf("dockerd did not start up: %q, %s", err, formatLogs(cfg.Logs))
+	if c.swarm {
+		if err := initSwarm(ctx, dockerAPI); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to init swarm: %s", formatLogs(cfg.Logs))
+		}
+		unsupported = mergeUnique(unsupported, swarmUnsupported)
 	}
 
-	dockerAPI, err := client.NewClientWithOpts(client.WithHost(d.Sock()))
+	address, err := hijackProxyListener(ctx, dockerAPI, &proxyGroup, deferF, cfg)
 	if err != nil {
 		return nil, nil, err
 	}
-	deferF.append(dockerAPI.Close)
 
-	err = waitForAPI(ctx, dockerAPI, 5*time.Second)
+	return backend{
+		address:             address,
+		rootless:            c.rootless,
+		isDockerd:           true,
+		unsupportedFeatures: unsupported,
+	}, cl, nil
+}
+
+// newExisting builds a backend around an already-running dockerd reachable
+// at host, skipping daemon spawning and cert/flag handling entirely. The
+// client is built with client.FromEnv followed by client.WithHost(host), so
+// DOCKER_TLS_VERIFY and DOCKER_CERT_PATH are honored while host takes
+// precedence over DOCKER_HOST.
+func (c moby) newExisting(ctx context.Context, cfg *BackendConfig, host string) (b Backend, cl func() error, err error) {
+	deferF := &multiCloser{}
+	cl = deferF.F()
+
+	defer func() {
+		if err != nil {
+			deferF.F()()
+			cl = nil
+		}
+	}()
+
+	var proxyGroup errgroup.Group
+	deferF.append(proxyGroup.Wait)
+
+	dockerAPI, err := client.NewClientWithOpts(client.FromEnv, client.WithHost(host))
 	if err != nil {
+		return nil, nil, err
+	}
+	deferF.append(dockerAPI.Close)
+
+	if err := waitForAPI(ctx, dockerAPI, 5*time.Second); err != nil {
 		return nil, nil, errors.Wrapf(err, "dockerd client api timed out: %s", formatLogs(cfg.Logs))
 	}
 
+	securityInsecure := false
+	if bkcfg, err := config.LoadFile(cfg.ConfigFile); err == nil && bkcfg.Entitlements != nil {
+		for _, e := range bkcfg.Entitlements {
+			if e == "security.insecure" {
+				securityInsecure = true
+			}
+		}
+	}
+
+	unsupported, err := detectUnsupportedFeatures(ctx, dockerAPI, securityInsecure)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to probe existing dockerd for supported features")
+	}
+
+	address, err := hijackProxyListener(ctx, dockerAPI, &proxyGroup, deferF, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return backend{
+		address:             address,
+		rootless:            c.rootless,
+		isDockerd:           true,
+		unsupportedFeatures: unsupported,
+	}, cl, nil
+}
+
+// hijackProxyListener starts a local unix-socket listener whose connections
+// are proxied to dockerAPI's /grpc hijack endpoint, and returns its address
+// as a unix:// URL. The listener and the goroutines copying data to/from it
+// are torn down via deferF/proxyGroup.
+func hijackProxyListener(ctx context.Context, dockerAPI *client.Client, proxyGroup *errgroup.Group, deferF *multiCloser, cfg *BackendConfig) (string, error) {
 	// Create a file descriptor to be used as a Unix domain socket.
 	// Remove it immediately (the name will still be valid for the socket) so that
 	// we don't leave files all over the users tmp tree.
 	f, err := os.CreateTemp("", "buildkit-integration")
 	if err != nil {
-		return
+		return "", err
 	}
 	localPath := f.Name()
 	f.Close()
@@ -173,7 +309,7 @@ func (c moby) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl func()
 
 	listener, err := net.Listen("unix", localPath)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "dockerd listener error: %s", formatLogs(cfg.Logs))
+		return "", errors.Wrapf(err, "dockerd listener error: %s", formatLogs(cfg.Logs))
 	}
 	deferF.append(listener.Close)
 
@@ -206,12 +342,129 @@ func (c moby) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl func()
 		}
 	})
 
-	return backend{
-		address:             "unix://" + listener.Addr().String(),
-		rootless:            c.rootless,
-		isDockerd:           true,
-		unsupportedFeatures: c.unsupported,
-	}, cl, nil
+	return "unix://" + listener.Addr().String(), nil
+}
+
+// tlsClient builds a docker client that talks to host over mTLS using the
+// given certificate bundle, mirroring how the external docker integration
+// harness constructs a client from DOCKER_CERT_PATH/DOCKER_TLS_VERIFY.
+func tlsClient(host string, certs *dockerd.TLSPaths) (*client.Client, error) {
+	tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+		CAFile:   certs.CACert,
+		CertFile: certs.ClientCert,
+		KeyFile:  certs.ClientKey,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build tls client config")
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	return client.NewClientWithOpts(
+		client.WithHost(host),
+		client.WithHTTPClient(httpClient),
+	)
+}
+
+// minContainerdSnapshotterVersion is the earliest dockerd release whose
+// containerd-snapshotter integration is complete enough to trust for the
+// exporter/platform/attestation features below.
+const minContainerdSnapshotterVersion = "23.0.0"
+
+// detectUnsupportedFeatures probes a running daemon's /info and /version to
+// figure out which Feature* constants it cannot exercise, instead of relying
+// on a static list keyed off a daemon name. That way a single dockerd binary
+// upgrade doesn't require editing this file.
+//
+// securityInsecureEnabled must reflect whether the daemon was actually
+// started with the security.insecure builder entitlement: almost every
+// Linux dockerd advertises apparmor or selinux in /info regardless of
+// whether that entitlement is wired up, so SecurityOptions can't be used as
+// a stand-in for it.
+func detectUnsupportedFeatures(ctx context.Context, dockerAPI *client.Client, securityInsecureEnabled bool) ([]string, error) {
+	info, err := dockerAPI.Info(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query dockerd /info")
+	}
+	v, err := dockerAPI.ServerVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query dockerd /version")
+	}
+
+	usesSnapshotter := usesContainerdSnapshotter(info) && !versions.LessThan(v.Version, minContainerdSnapshotterVersion)
+
+	var unsupported []string
+	if !usesSnapshotter {
+		// Without the containerd snapshotter, dockerd's builder can't
+		// produce or consume anything beyond a classic image export.
+		unsupported = append(unsupported,
+			FeatureCacheExport,
+			FeatureCacheImport,
+			FeatureCacheBackendAzblob,
+			FeatureCacheBackendGha,
+			FeatureCacheBackendLocal,
+			FeatureCacheBackendRegistry,
+			FeatureCacheBackendS3,
+			FeatureDirectPush,
+			FeatureImageExporter,
+			FeatureMultiCacheExport,
+			FeatureMultiPlatform,
+			FeatureOCIExporter,
+			FeatureOCILayout,
+			FeatureProvenance,
+			FeatureSBOM,
+		)
+	}
+	// The classic (non-containerd-snapshotter) builder can't honor
+	// RUN --security=insecure either, regardless of whether the
+	// security.insecure entitlement was passed to it.
+	if !usesSnapshotter || !securityInsecureEnabled {
+		unsupported = append(unsupported, FeatureSecurityMode)
+	}
+	// CNI networking isn't wired up by any of the workers in this file, and
+	// dockerd's /info has no field that would tell us otherwise.
+	unsupported = append(unsupported, FeatureCNINetwork)
+
+	return unsupported, nil
+}
+
+func usesContainerdSnapshotter(info types.Info) bool {
+	for _, kv := range info.DriverStatus {
+		if len(kv) == 2 && kv[0] == "driver-type" && strings.Contains(kv[1], "io.containerd.snapshotter") {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeUnique returns the union of a and b, preserving a's order and
+// dropping duplicates.
+func mergeUnique(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a))
+	out := append([]string{}, a...)
+	for _, f := range a {
+		seen[f] = struct{}{}
+	}
+	for _, f := range b {
+		if _, ok := seen[f]; !ok {
+			seen[f] = struct{}{}
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// freeTCPAddr returns a loopback address with an available port, e.g. for
+// dockerd's TLS-secured listener, a mirror registry or the swarm raft port.
+func freeTCPAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
 }
 
 func waitForAPI(ctx context.Context, apiClient *client.Client, d time.Duration) error {
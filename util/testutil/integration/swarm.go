@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// swarmUnsupported are features known not to work under Swarm orchestration,
+// merged into whatever detectUnsupportedFeatures already found missing for
+// the dockerd-swarm worker.
+var swarmUnsupported = []string{
+	FeatureMultiPlatform,
+}
+
+// initSwarm puts a freshly started dockerd into single-node swarm mode so
+// tests can exercise BuildKit's grpc hijack path while the daemon is
+// orchestrating services. It binds the raft listener to a free port on
+// loopback only, rather than the standard 2377, so it neither collides with
+// a host that already runs swarm (or a second dockerd-swarm worker) nor is
+// exposed off-box. It then waits for the node to actually report itself
+// active before returning.
+func initSwarm(ctx context.Context, dockerAPI *client.Client) error {
+	listenAddr, err := freeTCPAddr()
+	if err != nil {
+		return err
+	}
+	_, err = dockerAPI.SwarmInit(ctx, swarm.InitRequest{
+		ListenAddr:    listenAddr,
+		AdvertiseAddr: "127.0.0.1",
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to init swarm")
+	}
+	return waitForSwarmActive(ctx, dockerAPI, 5*time.Second)
+}
+
+// waitForSwarmActive polls /info until the daemon reports its swarm node as
+// active, the same way waitForAPI polls /_ping for the API itself.
+func waitForSwarmActive(ctx context.Context, dockerAPI *client.Client, d time.Duration) error {
+	step := 50 * time.Millisecond
+	i := 0
+	for {
+		info, err := dockerAPI.Info(ctx)
+		if err == nil && info.Swarm.LocalNodeState == swarm.LocalNodeStateActive {
+			return nil
+		}
+		i++
+		if time.Duration(i)*step > d {
+			return errors.New("swarm node did not become active")
+		}
+		time.Sleep(step)
+	}
+}
+
+// NewBuildServiceSpec returns a minimal single-replica swarm.ServiceSpec
+// running image with args, for tests that need to drive a build through a
+// Swarm service on this backend rather than a bare container.
+func (b backend) NewBuildServiceSpec(name, image string, args ...string) swarm.ServiceSpec {
+	replicas := uint64(1)
+	return swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: name},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image: image,
+				Args:  args,
+			},
+		},
+		Mode: swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+		},
+	}
+}